@@ -1,13 +1,151 @@
 package limit
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
 
 	goll "github.com/fabiofenoglio/goll"
 	"github.com/gin-gonic/gin"
 )
 
+// defaultLongRunningPattern classifies requests as long-running/streaming by
+// method and path, mirroring Kubernetes-style "watch/log/exec/stream"
+// sub-resources that are expected to hold a connection open for a long time.
+var defaultLongRunningPattern = regexp.MustCompile(`^(WATCH|GET) .*/(log|exec|stream)$`)
+
+func defaultLongRunningMatcher(c *gin.Context) bool {
+	return defaultLongRunningPattern.MatchString(c.Request.Method + " " + c.Request.URL.Path)
+}
+
+// RetryPolicy configures in-process retries of Limiter.Submit when it
+// returns an error, e.g. a transient synchronization failure against a
+// distributed backend. The zero value disables retries, preserving the
+// original behavior of failing straight to the error handler.
+type RetryPolicy struct {
+	// MaxRetries is the maximum number of additional attempts after the
+	// initial Submit call. Zero (the zero value) disables retries.
+	MaxRetries int
+
+	// InitialInterval is the lower bound of every decorrelated-jitter base
+	// interval; the first retry's base interval is drawn between
+	// InitialInterval and InitialInterval*Multiplier.
+	InitialInterval time.Duration
+
+	// MaxInterval caps the computed base interval before jitter is applied.
+	// Zero means no cap is applied.
+	MaxInterval time.Duration
+
+	// Multiplier scales the previous interval to get the upper bound of the
+	// next one. Defaults to 1.5 when <= 0.
+	Multiplier float64
+
+	// RandomizationFactor spreads the computed interval by up to this
+	// fraction in either direction. Defaults to 0.5 when nil; pass a pointer
+	// to 0 explicitly to disable this spread. The base interval itself is
+	// still drawn at random between InitialInterval and the previous
+	// interval times Multiplier.
+	RandomizationFactor *float64
+}
+
+// PermanentError wraps an error to mark it as non-retryable regardless of
+// Config.IsRetryable, mirroring the common "backoff.Permanent" idiom.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// defaultIsRetryable is used when Config.IsRetryable is not set: it retries
+// everything except a cancelled/expired request context and errors marked
+// as permanent via PermanentError.
+func defaultIsRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var permanent *PermanentError
+	return !errors.As(err, &permanent)
+}
+
+// HeaderMode controls which rate-limit response headers the middleware emits.
+//
+// Only the standard Retry-After header (RFC 9110) and the legacy X-Retry-In
+// header are ever emitted, both only on rejection. The IETF draft
+// "RateLimit-Limit"/"RateLimit-Remaining"/"RateLimit-Reset" headers are
+// intentionally not supported by any mode: goll.LoadLimiter does not expose
+// remaining capacity for a tenant, so there is nothing honest to put in
+// them. Revisit once goll grows that capability.
+type HeaderMode int
+
+const (
+	// HeadersLegacy is the default and preserves the original behavior of this
+	// package: only the proprietary X-Retry-In header is emitted, and only on
+	// rejection. This is the zero value so existing deployments are unaffected.
+	HeadersLegacy HeaderMode = iota
+
+	// HeadersOff disables every rate-limit response header, including the
+	// legacy X-Retry-In header.
+	HeadersOff
+
+	// HeadersRetryAfter emits the standard Retry-After header on rejection
+	// instead of the legacy X-Retry-In header.
+	HeadersRetryAfter
+
+	// HeadersBoth emits both the legacy X-Retry-In and the standard
+	// Retry-After headers on rejection.
+	HeadersBoth
+)
+
+func (m HeaderMode) emitsLegacy() bool {
+	return m == HeadersLegacy || m == HeadersBoth
+}
+
+func (m HeaderMode) emitsRetryAfter() bool {
+	return m == HeadersRetryAfter || m == HeadersBoth
+}
+
+// TenantKeySpec defines one bucket to submit load against when using
+// Config.TenantKeys to enforce several limits in a single middleware pass
+// (e.g. per-IP AND per-user AND global).
+type TenantKeySpec struct {
+	// Name identifies this bucket, e.g. in MultiSubmitResult.RejectedName.
+	Name string
+
+	// KeyFunc extracts the tenant key for this bucket from the request.
+	KeyFunc func(c *gin.Context) (string, error)
+
+	// Load multiplies the route's load for this bucket. Defaults to 1 (the
+	// route's load unchanged) when 0, so the same request can count as e.g.
+	// 1 unit globally but 5 units against a stricter per-IP bucket.
+	Load uint64
+
+	// Limiter is submitted to for this bucket. Falls back to Config.Limiter
+	// when nil, so buckets can share a limiter or each use their own.
+	Limiter goll.LoadLimiter
+}
+
+// MultiSubmitResult is passed to Config.MultiAbortHandler when a request is
+// rejected by any bucket in Config.TenantKeys. Results holds the SubmitResult
+// of each bucket submitted to, keyed by TenantKeySpec.Name, and RejectedName
+// identifies the bucket that caused the rejection. Buckets are submitted in
+// order and submission stops at the rejecting bucket, so buckets after it
+// have no entry in Results.
+type MultiSubmitResult struct {
+	Results      map[string]goll.SubmitResult
+	RejectedName string
+}
+
 type Config struct {
 	Limiter          goll.LoadLimiter
 	DefaultRouteLoad uint64
@@ -16,6 +154,77 @@ type Config struct {
 	AcceptHandler    func(c *gin.Context, result goll.SubmitResult)
 	AbortHandler     func(c *gin.Context, result goll.SubmitResult)
 	ErrorHandler     func(c *gin.Context, err error)
+
+	// HeaderMode selects which rate-limit response headers are emitted.
+	// Defaults to HeadersLegacy, preserving the behavior of this package
+	// before HeaderMode was introduced.
+	HeaderMode HeaderMode
+
+	// BypassFunc, when non-nil, is checked before any limiter interaction.
+	// If it returns true the request skips load accounting entirely: the
+	// middleware calls AcceptHandler (or c.Next() by default) directly
+	// without calling Limiter.Submit. This is meant for trusted internal
+	// clients that must never be throttled.
+	BypassFunc func(c *gin.Context) bool
+
+	// APIKeyHeader and APIKeys are a convenience shortcut for BypassFunc:
+	// if both are set (and BypassFunc is not), requests carrying one of
+	// APIKeys in the APIKeyHeader header bypass the limiter.
+	APIKeyHeader string
+	APIKeys      []string
+
+	// MaxInFlight, when used with NewInFlightMiddleware, caps the number of
+	// concurrently executing handlers per tenant. It is independent of the
+	// windowed load accounting done by Limiter/Submit and complements it by
+	// guarding against a thundering herd of long-running requests.
+	MaxInFlight uint64
+
+	// InFlightWaitTimeout is how long a request may wait for an in-flight
+	// slot to free up before being rejected. Zero means reject immediately
+	// if no slot is available.
+	InFlightWaitTimeout time.Duration
+
+	// LongRunningMatcher classifies a request as long-running/streaming
+	// (e.g. websockets, SSE, log tailing). Matching requests are routed to
+	// LongRunningLimiter instead of Limiter, so a handful of long-lived
+	// connections cannot starve the windowed budget used by short requests.
+	// If LongRunningLimiter is set and LongRunningMatcher is not, it
+	// defaults to matching method+path against a Kubernetes-style
+	// watch/log/exec/stream pattern.
+	LongRunningMatcher func(c *gin.Context) bool
+
+	// LongRunningLimiter, when set, is used instead of Limiter for requests
+	// matched by LongRunningMatcher. When unset, matched requests skip
+	// windowed load accounting entirely; pair this with NewInFlightMiddleware
+	// to still cap how many of them can run concurrently.
+	LongRunningLimiter goll.LoadLimiter
+
+	// LoadFunc, when set, computes the load to submit for a request instead
+	// of the static DefaultRouteLoad/WithLoad value, e.g. based on
+	// Content-Length, a page_size query parameter, or the request body.
+	// It falls back to the static load whenever it returns 0.
+	LoadFunc func(c *gin.Context) uint64
+
+	// RetryPolicy retries Limiter.Submit in-process when it returns an
+	// error. The zero value disables retries.
+	RetryPolicy RetryPolicy
+
+	// IsRetryable decides whether an error from Limiter.Submit should be
+	// retried under RetryPolicy. Defaults to defaultIsRetryable.
+	IsRetryable func(err error) bool
+
+	// TenantKeys, when non-empty, switches the middleware into multi-key
+	// mode: load is submitted against every spec in order, and the request
+	// is rejected if any of them rejects it. TenantKey/TenantKeyFunc are
+	// ignored when this is set.
+	TenantKeys []TenantKeySpec
+
+	// MultiAbortHandler is used instead of AbortHandler when TenantKeys is
+	// set, since a multi-key rejection carries a MultiSubmitResult rather
+	// than a single goll.SubmitResult. If nil, the default response is an
+	// HTTP 429 with the existing retry headers computed from the slowest
+	// bucket to recover.
+	MultiAbortHandler func(c *gin.Context, result MultiSubmitResult)
 }
 
 type loadLimiterMiddleware struct {
@@ -26,29 +235,97 @@ type loadLimiterMiddleware struct {
 	acceptHandler func(c *gin.Context, result goll.SubmitResult)
 	abortHandler  func(c *gin.Context, result goll.SubmitResult)
 	errorHandler  func(c *gin.Context, err error)
+	headerMode    HeaderMode
+	bypassFunc    func(c *gin.Context) bool
+
+	longRunningMatcher func(c *gin.Context) bool
+	longRunningLimiter goll.LoadLimiter
+
+	loadFunc func(c *gin.Context) uint64
+
+	retryPolicy RetryPolicy
+	isRetryable func(err error) bool
+
+	tenantKeys        []TenantKeySpec
+	multiAbortHandler func(c *gin.Context, result MultiSubmitResult)
 }
 
 func NewLimiterMiddleware(config Config) *loadLimiterMiddleware {
 	return &loadLimiterMiddleware{
-		limiter:       config.Limiter,
-		load:          config.DefaultRouteLoad,
-		acceptHandler: config.AcceptHandler,
-		abortHandler:  config.AbortHandler,
-		errorHandler:  config.ErrorHandler,
-		tenantKey:     config.TenantKey,
-		tenantKeyFunc: config.TenantKeyFunc,
+		limiter:            config.Limiter,
+		load:               config.DefaultRouteLoad,
+		acceptHandler:      config.AcceptHandler,
+		abortHandler:       config.AbortHandler,
+		errorHandler:       config.ErrorHandler,
+		tenantKey:          config.TenantKey,
+		tenantKeyFunc:      config.TenantKeyFunc,
+		headerMode:         config.HeaderMode,
+		bypassFunc:         buildBypassFunc(config),
+		longRunningMatcher: buildLongRunningMatcher(config),
+		longRunningLimiter: config.LongRunningLimiter,
+		loadFunc:           config.LoadFunc,
+		retryPolicy:        config.RetryPolicy,
+		isRetryable:        config.IsRetryable,
+		tenantKeys:         config.TenantKeys,
+		multiAbortHandler:  config.MultiAbortHandler,
+	}
+}
+
+// buildLongRunningMatcher resolves Config.LongRunningMatcher, falling back to
+// defaultLongRunningMatcher when a LongRunningLimiter is configured without
+// an explicit matcher. It returns nil when long-running classification is
+// not in use, so existing deployments are unaffected.
+func buildLongRunningMatcher(config Config) func(c *gin.Context) bool {
+	if config.LongRunningMatcher != nil {
+		return config.LongRunningMatcher
+	}
+	if config.LongRunningLimiter == nil {
+		return nil
+	}
+	return defaultLongRunningMatcher
+}
+
+// buildBypassFunc resolves Config.BypassFunc, falling back to the
+// APIKeyHeader/APIKeys shortcut when BypassFunc is not set. It returns nil
+// when neither is configured, meaning no request bypasses the limiter.
+func buildBypassFunc(config Config) func(c *gin.Context) bool {
+	if config.BypassFunc != nil {
+		return config.BypassFunc
+	}
+	if config.APIKeyHeader == "" || len(config.APIKeys) == 0 {
+		return nil
+	}
+
+	allowed := make(map[string]struct{}, len(config.APIKeys))
+	for _, key := range config.APIKeys {
+		allowed[key] = struct{}{}
+	}
+	header := config.APIKeyHeader
+
+	return func(c *gin.Context) bool {
+		_, ok := allowed[c.GetHeader(header)]
+		return ok
 	}
 }
 
 func (instance *loadLimiterMiddleware) clone() *loadLimiterMiddleware {
 	return &loadLimiterMiddleware{
-		limiter:       instance.limiter,
-		load:          instance.load,
-		acceptHandler: instance.acceptHandler,
-		abortHandler:  instance.abortHandler,
-		errorHandler:  instance.errorHandler,
-		tenantKey:     instance.tenantKey,
-		tenantKeyFunc: instance.tenantKeyFunc,
+		limiter:            instance.limiter,
+		load:               instance.load,
+		acceptHandler:      instance.acceptHandler,
+		abortHandler:       instance.abortHandler,
+		errorHandler:       instance.errorHandler,
+		tenantKey:          instance.tenantKey,
+		tenantKeyFunc:      instance.tenantKeyFunc,
+		headerMode:         instance.headerMode,
+		bypassFunc:         instance.bypassFunc,
+		longRunningMatcher: instance.longRunningMatcher,
+		longRunningLimiter: instance.longRunningLimiter,
+		loadFunc:           instance.loadFunc,
+		retryPolicy:        instance.retryPolicy,
+		isRetryable:        instance.isRetryable,
+		tenantKeys:         instance.tenantKeys,
+		multiAbortHandler:  instance.multiAbortHandler,
 	}
 }
 
@@ -62,6 +339,16 @@ func (instance *loadLimiterMiddleware) WithLoad(load uint64) gin.HandlerFunc {
 	return cloned.Default()
 }
 
+// WithLoadFunc configures a per-request load function for this route,
+// overriding any load function from the original Config. The static load
+// (DefaultRouteLoad or a prior WithLoad) remains the fallback for requests
+// where fn returns 0.
+func (instance *loadLimiterMiddleware) WithLoadFunc(fn func(c *gin.Context) uint64) gin.HandlerFunc {
+	cloned := instance.clone()
+	cloned.loadFunc = fn
+	return cloned.Default()
+}
+
 func (instance *loadLimiterMiddleware) handleError(c *gin.Context, err error) {
 	if instance.errorHandler != nil {
 		// run the user error handler if any.
@@ -72,14 +359,18 @@ func (instance *loadLimiterMiddleware) handleError(c *gin.Context, err error) {
 	}
 }
 
-func (instance *loadLimiterMiddleware) handleRejection(c *gin.Context, res goll.SubmitResult) {
+func (instance *loadLimiterMiddleware) handleRejection(c *gin.Context, res goll.SubmitResult, tenantKey string) {
+	if instance.headerMode.emitsRetryAfter() && res.RetryInAvailable {
+		c.Header("Retry-After", strconv.FormatInt(ceilSeconds(res.RetryIn), 10))
+	}
+
 	if instance.abortHandler != nil {
 		// run the user abort handler if any.
 		instance.abortHandler(c, res)
 	} else {
 		// if no custom handler is present, by default
 		// we send an HTTP 429 response with X-Retry-In header if available
-		if res.RetryInAvailable {
+		if instance.headerMode.emitsLegacy() && res.RetryInAvailable {
 			c.Header("X-Retry-In", fmt.Sprintf("%v", res.RetryIn.Milliseconds()))
 		}
 
@@ -87,7 +378,7 @@ func (instance *loadLimiterMiddleware) handleRejection(c *gin.Context, res goll.
 	}
 }
 
-func (instance *loadLimiterMiddleware) handleAccept(c *gin.Context, res goll.SubmitResult) {
+func (instance *loadLimiterMiddleware) handleAccept(c *gin.Context, res goll.SubmitResult, tenantKey string) {
 	if instance.acceptHandler != nil {
 		// run the user accept handler if any.
 		instance.acceptHandler(c, res)
@@ -96,6 +387,15 @@ func (instance *loadLimiterMiddleware) handleAccept(c *gin.Context, res goll.Sub
 	}
 }
 
+// ceilSeconds rounds d up to the nearest whole second, as required for the
+// integer-valued Retry-After header.
+func ceilSeconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64((d + time.Second - 1) / time.Second)
+}
+
 func (instance *loadLimiterMiddleware) effectiveTenantKey(c *gin.Context) (string, error) {
 	if instance.tenantKeyFunc != nil {
 		return instance.tenantKeyFunc(c)
@@ -103,6 +403,18 @@ func (instance *loadLimiterMiddleware) effectiveTenantKey(c *gin.Context) (strin
 	return instance.tenantKey, nil
 }
 
+// effectiveLoad returns the load to submit for c, consulting loadFunc if one
+// is configured. It falls back to the static per-route load whenever
+// loadFunc is absent or returns 0, so a route can still set a baseline cost.
+func (instance *loadLimiterMiddleware) effectiveLoad(c *gin.Context) uint64 {
+	if instance.loadFunc != nil {
+		if load := instance.loadFunc(c); load > 0 {
+			return load
+		}
+	}
+	return instance.load
+}
+
 func routeLoadLimiter(instance *loadLimiterMiddleware) gin.HandlerFunc {
 	err := validateConfig(instance)
 	if err != nil {
@@ -110,12 +422,26 @@ func routeLoadLimiter(instance *loadLimiterMiddleware) gin.HandlerFunc {
 	}
 
 	return func(c *gin.Context) {
-		if instance.load <= 0 {
+		if instance.bypassFunc != nil && instance.bypassFunc(c) {
+			// the client is privileged: skip load accounting entirely but
+			// still run the accept path so downstream handlers execute.
+			tenantKey, _ := instance.effectiveTenantKey(c)
+			instance.handleAccept(c, goll.SubmitResult{Accepted: true}, tenantKey)
+			return
+		}
+
+		load := instance.effectiveLoad(c)
+		if load <= 0 {
 			// no need to check if route load is zero
 			c.Next()
 			return
 		}
 
+		if len(instance.tenantKeys) > 0 {
+			instance.submitMulti(c, load)
+			return
+		}
+
 		tenantKey, err := instance.effectiveTenantKey(c)
 		// if an error occured, run the error handler.
 		// not that a rejected load request is not an error.
@@ -125,33 +451,220 @@ func routeLoadLimiter(instance *loadLimiterMiddleware) gin.HandlerFunc {
 			return
 		}
 
-		// submit load request to limiter
-		res, err := instance.limiter.Submit(tenantKey, instance.load)
+		limiter := instance.limiter
 
-		// if an error occured, run the error handler.
-		// not that a rejected load request is not an error.
-		// an error only occurs when synchronization is enabled and fails
-		// or something like that
+		if instance.longRunningMatcher != nil && instance.longRunningMatcher(c) {
+			if instance.longRunningLimiter != nil {
+				// route long-running requests to their own limiter pool so
+				// they cannot starve the budget used by short requests.
+				limiter = instance.longRunningLimiter
+			} else {
+				// no secondary pool configured: skip windowed accounting
+				// for long-running requests entirely.
+				instance.handleAccept(c, goll.SubmitResult{Accepted: true}, tenantKey)
+				return
+			}
+		}
+
+		instance.submit(c, limiter, tenantKey, load)
+	}
+}
+
+// submit submits load to limiter for tenantKey and runs the matching
+// error/rejection/accept handler.
+func (instance *loadLimiterMiddleware) submit(c *gin.Context, limiter goll.LoadLimiter, tenantKey string, load uint64) {
+	res, err := instance.submitWithRetry(c, limiter, tenantKey, load)
+
+	// if an error occured (after exhausting retries, if configured), run the
+	// error handler. note that a rejected load request is not an error.
+	// an error only occurs when synchronization is enabled and fails
+	// or something like that
+	if err != nil {
+		instance.handleError(c, err)
+		return
+	}
+
+	// if the request was rejected we run the abort handler
+	if !res.Accepted {
+		instance.handleRejection(c, res, tenantKey)
+		return
+	}
+
+	// the request was accepted so we can go on.
+	instance.handleAccept(c, res, tenantKey)
+}
+
+// submitWithRetry calls limiter.Submit, retrying on error according to
+// retryPolicy/isRetryable. It gives up early if the request context is
+// cancelled while waiting for the next attempt.
+func (instance *loadLimiterMiddleware) submitWithRetry(c *gin.Context, limiter goll.LoadLimiter, tenantKey string, load uint64) (goll.SubmitResult, error) {
+	res, err := limiter.Submit(tenantKey, load)
+	if err == nil {
+		return res, nil
+	}
+
+	userIsRetryable := instance.isRetryable
+	if userIsRetryable == nil {
+		userIsRetryable = defaultIsRetryable
+	}
+	isRetryable := func(err error) bool {
+		var permanent *PermanentError
+		return !errors.As(err, &permanent) && userIsRetryable(err)
+	}
+
+	interval := instance.retryPolicy.InitialInterval
+
+	for attempt := 0; attempt < instance.retryPolicy.MaxRetries && isRetryable(err); attempt++ {
+		select {
+		case <-c.Request.Context().Done():
+			return res, err
+		case <-time.After(instance.nextRetryDelay(&interval)):
+		}
+
+		res, err = limiter.Submit(tenantKey, load)
+		if err == nil {
+			return res, nil
+		}
+	}
+
+	return res, err
+}
+
+// nextRetryDelay computes the next decorrelated-jitter backoff delay and
+// advances prev to the new base interval (without jitter), as the basis for
+// the following call.
+func (instance *loadLimiterMiddleware) nextRetryDelay(prev *time.Duration) time.Duration {
+	policy := instance.retryPolicy
+
+	multiplier := policy.Multiplier
+	if multiplier <= 0 {
+		multiplier = 1.5
+	}
+	randomizationFactor := 0.5
+	if policy.RandomizationFactor != nil {
+		randomizationFactor = *policy.RandomizationFactor
+	}
+
+	upper := time.Duration(float64(*prev) * multiplier)
+	rangeSize := int64(upper - policy.InitialInterval)
+
+	base := policy.InitialInterval
+	if rangeSize > 0 {
+		base += time.Duration(rand.Int63n(rangeSize + 1))
+	}
+	if policy.MaxInterval > 0 && base > policy.MaxInterval {
+		base = policy.MaxInterval
+	}
+	*prev = base
+
+	jitter := 1 + (rand.Float64()*2-1)*randomizationFactor
+	return time.Duration(float64(base) * jitter)
+}
+
+// submitMulti submits load against every spec in instance.tenantKeys, in
+// order, rejecting as soon as any of them does not accept it.
+func (instance *loadLimiterMiddleware) submitMulti(c *gin.Context, load uint64) {
+	results := make(map[string]goll.SubmitResult, len(instance.tenantKeys))
+
+	for _, spec := range instance.tenantKeys {
+		tenantKey, err := spec.KeyFunc(c)
+		if err != nil {
+			instance.handleError(c, err)
+			return
+		}
+
+		limiter := spec.Limiter
+		if limiter == nil {
+			limiter = instance.limiter
+		}
+
+		specLoad := load
+		if spec.Load > 0 {
+			specLoad = load * spec.Load
+		}
+
+		res, err := instance.submitWithRetry(c, limiter, tenantKey, specLoad)
 		if err != nil {
 			instance.handleError(c, err)
 			return
 		}
 
-		// if the request was rejected we run the abort handler
+		results[spec.Name] = res
+
 		if !res.Accepted {
-			instance.handleRejection(c, res)
+			instance.handleMultiRejection(c, MultiSubmitResult{
+				Results:      results,
+				RejectedName: spec.Name,
+			})
 			return
 		}
+	}
+
+	instance.handleMultiAccept(c)
+}
 
-		// the request was accepted so we can go on.
-		instance.handleAccept(c, res)
+// handleMultiAccept runs the accept path for a successful multi-key submit.
+// There is no single tenant key in composite mode, so unlike handleAccept it
+// never needs one.
+func (instance *loadLimiterMiddleware) handleMultiAccept(c *gin.Context) {
+	if instance.acceptHandler != nil {
+		instance.acceptHandler(c, goll.SubmitResult{Accepted: true})
+	} else {
+		c.Next()
 	}
 }
 
+// handleMultiRejection responds to a multi-key rejection. Without a custom
+// MultiAbortHandler, the merged Retry-After/X-Retry-In is the longest of the
+// individual buckets' retry hints, since the client must wait for all of
+// them to allow the request.
+func (instance *loadLimiterMiddleware) handleMultiRejection(c *gin.Context, res MultiSubmitResult) {
+	if instance.multiAbortHandler != nil {
+		instance.multiAbortHandler(c, res)
+		return
+	}
+
+	if retryIn := maxRetryIn(res.Results); retryIn > 0 {
+		if instance.headerMode.emitsLegacy() {
+			c.Header("X-Retry-In", fmt.Sprintf("%v", retryIn.Milliseconds()))
+		}
+		if instance.headerMode.emitsRetryAfter() {
+			c.Header("Retry-After", strconv.FormatInt(ceilSeconds(retryIn), 10))
+		}
+	}
+
+	c.AbortWithStatus(429)
+}
+
+// maxRetryIn returns the largest RetryIn across results that have one
+// available, used to merge several buckets' retry hints into one value.
+func maxRetryIn(results map[string]goll.SubmitResult) time.Duration {
+	var longest time.Duration
+	for _, res := range results {
+		if res.RetryInAvailable && res.RetryIn > longest {
+			longest = res.RetryIn
+		}
+	}
+	return longest
+}
+
 func validateConfig(config *loadLimiterMiddleware) error {
 	if config == nil {
 		return errors.New("nil config")
 	}
+
+	if len(config.tenantKeys) > 0 {
+		for _, spec := range config.tenantKeys {
+			if spec.KeyFunc == nil {
+				return errors.New("KeyFunc is required for every TenantKeySpec")
+			}
+			if spec.Limiter == nil && config.limiter == nil {
+				return fmt.Errorf("TenantKeySpec %q needs a Limiter since Config.Limiter is not set", spec.Name)
+			}
+		}
+		return nil
+	}
+
 	if config.limiter == nil {
 		return errors.New("limiter is required")
 	}
@@ -163,3 +676,158 @@ func validateConfig(config *loadLimiterMiddleware) error {
 	}
 	return nil
 }
+
+// inFlightMiddleware gates the number of concurrently executing handlers per
+// tenant. Unlike loadLimiterMiddleware, which accounts for load over a time
+// window, this middleware only cares about how many requests are in flight
+// right now, and is meant to be chained alongside it on the same route.
+type inFlightMiddleware struct {
+	tenantKey     string
+	tenantKeyFunc func(c *gin.Context) (string, error)
+	maxInFlight   uint64
+	waitTimeout   time.Duration
+	abortHandler  func(c *gin.Context, result goll.SubmitResult)
+	errorHandler  func(c *gin.Context, err error)
+
+	mu      sync.Mutex
+	buckets map[string]*inFlightBucket
+}
+
+// inFlightBucket is the counting semaphore for a single tenant key, plus a
+// refcount of the requests currently holding or waiting on it. Once refs
+// drops back to zero the bucket is removed from inFlightMiddleware.buckets,
+// so the map only ever holds entries for tenant keys with a request in
+// flight rather than growing for every distinct key ever seen.
+type inFlightBucket struct {
+	sem  chan struct{}
+	refs int
+}
+
+func NewInFlightMiddleware(config Config) *inFlightMiddleware {
+	return &inFlightMiddleware{
+		tenantKey:     config.TenantKey,
+		tenantKeyFunc: config.TenantKeyFunc,
+		maxInFlight:   config.MaxInFlight,
+		waitTimeout:   config.InFlightWaitTimeout,
+		abortHandler:  config.AbortHandler,
+		errorHandler:  config.ErrorHandler,
+		buckets:       make(map[string]*inFlightBucket),
+	}
+}
+
+func (instance *inFlightMiddleware) effectiveTenantKey(c *gin.Context) (string, error) {
+	if instance.tenantKeyFunc != nil {
+		return instance.tenantKeyFunc(c)
+	}
+	return instance.tenantKey, nil
+}
+
+// acquireBucket returns the semaphore bucket for tenantKey, creating it on
+// first use, and marks the caller as holding a reference to it. The caller
+// must call releaseBucket(tenantKey) exactly once when done, regardless of
+// whether it ever acquires a slot on the semaphore.
+func (instance *inFlightMiddleware) acquireBucket(tenantKey string) *inFlightBucket {
+	instance.mu.Lock()
+	defer instance.mu.Unlock()
+
+	bucket, ok := instance.buckets[tenantKey]
+	if !ok {
+		bucket = &inFlightBucket{sem: make(chan struct{}, instance.maxInFlight)}
+		instance.buckets[tenantKey] = bucket
+	}
+	bucket.refs++
+	return bucket
+}
+
+// releaseBucket drops the caller's reference to tenantKey's bucket, and
+// removes the bucket once no request is holding or waiting on it.
+func (instance *inFlightMiddleware) releaseBucket(tenantKey string) {
+	instance.mu.Lock()
+	defer instance.mu.Unlock()
+
+	bucket, ok := instance.buckets[tenantKey]
+	if !ok {
+		return
+	}
+	bucket.refs--
+	if bucket.refs <= 0 {
+		delete(instance.buckets, tenantKey)
+	}
+}
+
+func (instance *inFlightMiddleware) handleError(c *gin.Context, err error) {
+	if instance.errorHandler != nil {
+		// run the user error handler if any.
+		instance.errorHandler(c, err)
+	} else {
+		// if no custom handler is present, panic
+		panic(fmt.Errorf("error submitting load request: %w", err))
+	}
+}
+
+func (instance *inFlightMiddleware) handleRejection(c *gin.Context) {
+	if instance.abortHandler != nil {
+		// run the user abort handler if any. there is no SubmitResult for an
+		// in-flight rejection, so we hand it a rejected zero-value one.
+		instance.abortHandler(c, goll.SubmitResult{Accepted: false})
+	} else {
+		c.AbortWithStatus(429)
+	}
+}
+
+func (instance *inFlightMiddleware) Default() gin.HandlerFunc {
+	err := validateInFlightConfig(instance)
+	if err != nil {
+		panic(err)
+	}
+
+	return func(c *gin.Context) {
+		tenantKey, err := instance.effectiveTenantKey(c)
+		if err != nil {
+			instance.handleError(c, err)
+			return
+		}
+
+		bucket := instance.acquireBucket(tenantKey)
+		defer instance.releaseBucket(tenantKey)
+
+		if instance.waitTimeout <= 0 {
+			select {
+			case bucket.sem <- struct{}{}:
+			default:
+				instance.handleRejection(c)
+				return
+			}
+		} else {
+			timer := time.NewTimer(instance.waitTimeout)
+			defer timer.Stop()
+
+			select {
+			case bucket.sem <- struct{}{}:
+			case <-timer.C:
+				instance.handleRejection(c)
+				return
+			}
+		}
+
+		defer func() { <-bucket.sem }()
+
+		c.Next()
+	}
+}
+
+func validateInFlightConfig(config *inFlightMiddleware) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+	if config.maxInFlight == 0 {
+		return errors.New("MaxInFlight is required")
+	}
+	if config.tenantKey == "" && config.tenantKeyFunc == nil {
+		return errors.New("one of TenantKey or TenantKeyFunc is required")
+	}
+	if config.tenantKey != "" && config.tenantKeyFunc != nil {
+		return errors.New("only one of TenantKey or TenantKeyFunc is required")
+	}
+	return nil
+}
@@ -1,10 +1,12 @@
 package limit
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
-	"runtime"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -13,6 +15,423 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// waitForServer blocks until addr is accepting connections, so tests don't
+// race against the goroutine running r.Run.
+func waitForServer(addr string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.DialTimeout("tcp", addr, 50*time.Millisecond)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// flakyLimiter fails the first failures calls to Submit with a transient
+// error, then succeeds, to exercise Config.RetryPolicy without needing a
+// real distributed backend that can be made to misbehave on demand. It
+// implements goll.LoadLimiter in full, but only Submit is exercised by the
+// middleware code paths under test here.
+type flakyLimiter struct {
+	mu       sync.Mutex
+	failures int
+	calls    int
+}
+
+func (f *flakyLimiter) Probe(tenantKey string, load uint64) (bool, error) {
+	return true, nil
+}
+
+func (f *flakyLimiter) Submit(tenantKey string, load uint64) (goll.SubmitResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls++
+	if f.calls <= f.failures {
+		return goll.SubmitResult{}, errors.New("transient backend error")
+	}
+	return goll.SubmitResult{Accepted: true}, nil
+}
+
+func (f *flakyLimiter) SubmitUntil(tenantKey string, load uint64, timeout time.Duration) error {
+	res, err := f.Submit(tenantKey, load)
+	if err != nil {
+		return err
+	}
+	if !res.Accepted {
+		return goll.ErrLoadRequestRejected
+	}
+	return nil
+}
+
+func (f *flakyLimiter) SubmitUntilWithDetails(tenantKey string, load uint64, timeout time.Duration) goll.SubmitUntilResult {
+	return goll.SubmitUntilResult{AttemptsNumber: 1, Error: f.SubmitUntil(tenantKey, load, timeout)}
+}
+
+func (f *flakyLimiter) IsComposite() bool {
+	return false
+}
+
+// TestHeaderModeRetryAfter checks that HeadersRetryAfter emits the standard Retry-After
+// header on rejection instead of the legacy X-Retry-In header, and that it
+// never emits the RateLimit-Limit/Remaining/Reset headers, since goll.LoadLimiter
+// does not expose remaining capacity to compute them honestly.
+func TestHeaderModeRetryAfter(t *testing.T) {
+	r := gin.Default()
+
+	limiter, _ := goll.New(&goll.Config{
+		MaxLoad:    1,
+		WindowSize: 3 * time.Second,
+	})
+
+	ginLimiter := NewLimiterMiddleware(Config{
+		Limiter:          limiter,
+		DefaultRouteLoad: 1,
+		TenantKey:        "fixed",
+		HeaderMode:       HeadersRetryAfter,
+	})
+
+	r.GET("/", ginLimiter.Default(), func(c *gin.Context) {})
+
+	go func() {
+		err := r.Run(":9001")
+		if err != nil {
+			t.Error("error running the test http server", err.Error())
+		}
+	}()
+
+	waitForServer("127.0.0.1:9001")
+
+	resp, err := http.DefaultClient.Get("http://127.0.0.1:9001")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	resp, err = http.DefaultClient.Get("http://127.0.0.1:9001")
+	assert.NoError(t, err)
+	assert.Equal(t, 429, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	assert.Empty(t, resp.Header.Get("X-Retry-In"))
+	assert.Empty(t, resp.Header.Get("RateLimit-Limit"))
+	assert.Empty(t, resp.Header.Get("RateLimit-Remaining"))
+	assert.Empty(t, resp.Header.Get("RateLimit-Reset"))
+}
+
+// TestAPIKeyBypass checks that requests carrying a configured API key skip
+// the limiter entirely, even after the limit has been exhausted for
+// unauthenticated traffic.
+func TestAPIKeyBypass(t *testing.T) {
+	r := gin.Default()
+
+	limiter, _ := goll.New(&goll.Config{
+		MaxLoad:    1,
+		WindowSize: 3 * time.Second,
+	})
+
+	ginLimiter := NewLimiterMiddleware(Config{
+		Limiter:          limiter,
+		DefaultRouteLoad: 1,
+		TenantKey:        "fixed",
+		APIKeyHeader:     "X-API-Key",
+		APIKeys:          []string{"trusted-internal-key"},
+	})
+
+	r.GET("/", ginLimiter.Default(), func(c *gin.Context) {})
+
+	go func() {
+		err := r.Run(":9002")
+		if err != nil {
+			t.Error("error running the test http server", err.Error())
+		}
+	}()
+
+	waitForServer("127.0.0.1:9002")
+
+	// exhaust the limit for unauthenticated requests.
+	resp, err := http.DefaultClient.Get("http://127.0.0.1:9002")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	resp, err = http.DefaultClient.Get("http://127.0.0.1:9002")
+	assert.NoError(t, err)
+	assert.Equal(t, 429, resp.StatusCode)
+
+	// a request carrying the trusted API key bypasses the limiter regardless.
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:9002", nil)
+	req.Header.Add("X-API-Key", "trusted-internal-key")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+// TestInFlightMiddleware checks that NewInFlightMiddleware caps the number
+// of concurrently executing handlers per tenant, independent of the
+// windowed load limiter, and rejects the request that would exceed the cap.
+func TestInFlightMiddleware(t *testing.T) {
+	r := gin.Default()
+
+	inFlightLimiter := NewInFlightMiddleware(Config{
+		TenantKey:   "fixed",
+		MaxInFlight: 1,
+	})
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	r.GET("/", inFlightLimiter.Default(), func(c *gin.Context) {
+		started <- struct{}{}
+		<-release
+		c.Status(200)
+	})
+
+	go func() {
+		err := r.Run(":9003")
+		if err != nil {
+			t.Error("error running the test http server", err.Error())
+		}
+	}()
+
+	waitForServer("127.0.0.1:9003")
+
+	var wg sync.WaitGroup
+	statuses := make([]int, 2)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		resp, err := http.DefaultClient.Get("http://127.0.0.1:9003")
+		if err != nil {
+			t.Error("unexpected error in http request", err.Error())
+			return
+		}
+		statuses[0] = resp.StatusCode
+	}()
+
+	// wait until the first request is holding the in-flight slot before
+	// firing the second one, so the outcome is deterministic.
+	<-started
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		resp, err := http.DefaultClient.Get("http://127.0.0.1:9003")
+		if err != nil {
+			t.Error("unexpected error in http request", err.Error())
+			return
+		}
+		statuses[1] = resp.StatusCode
+	}()
+
+	// give the second request a chance to reach (and be rejected by) the
+	// middleware before releasing the first one.
+	time.Sleep(100 * time.Millisecond)
+	release <- struct{}{}
+
+	wg.Wait()
+
+	assert.Contains(t, statuses, 200)
+	assert.Contains(t, statuses, 429)
+}
+
+// TestLongRunningLimiterPool checks that requests matched by
+// LongRunningMatcher are routed to LongRunningLimiter instead of the default
+// Limiter, so they keep succeeding even after the default limiter's budget
+// is exhausted.
+func TestLongRunningLimiterPool(t *testing.T) {
+	r := gin.Default()
+
+	limiter, _ := goll.New(&goll.Config{
+		MaxLoad:    1,
+		WindowSize: 3 * time.Second,
+	})
+	longRunningLimiter, _ := goll.New(&goll.Config{
+		MaxLoad:    100,
+		WindowSize: 3 * time.Second,
+	})
+
+	ginLimiter := NewLimiterMiddleware(Config{
+		Limiter:          limiter,
+		DefaultRouteLoad: 1,
+		TenantKey:        "fixed",
+		LongRunningMatcher: func(c *gin.Context) bool {
+			return c.Request.URL.Path == "/stream"
+		},
+		LongRunningLimiter: longRunningLimiter,
+	})
+
+	r.GET("/", ginLimiter.Default(), func(c *gin.Context) {})
+	r.GET("/stream", ginLimiter.Default(), func(c *gin.Context) {})
+
+	go func() {
+		err := r.Run(":9004")
+		if err != nil {
+			t.Error("error running the test http server", err.Error())
+		}
+	}()
+
+	waitForServer("127.0.0.1:9004")
+
+	// exhaust the default limiter's budget.
+	resp, err := http.DefaultClient.Get("http://127.0.0.1:9004")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	resp, err = http.DefaultClient.Get("http://127.0.0.1:9004")
+	assert.NoError(t, err)
+	assert.Equal(t, 429, resp.StatusCode)
+
+	// requests to the long-running route keep succeeding, since they are
+	// accounted against longRunningLimiter instead.
+	for i := 0; i < 5; i++ {
+		resp, err = http.DefaultClient.Get("http://127.0.0.1:9004/stream")
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+	}
+}
+
+// TestWithLoadFunc checks that WithLoadFunc computes the submitted load from
+// the request instead of using a static per-route value.
+func TestWithLoadFunc(t *testing.T) {
+	r := gin.Default()
+
+	limiter, _ := goll.New(&goll.Config{
+		MaxLoad:    10,
+		WindowSize: 3 * time.Second,
+	})
+
+	ginLimiter := NewLimiterMiddleware(Config{
+		Limiter:          limiter,
+		DefaultRouteLoad: 1,
+		TenantKey:        "fixed",
+	})
+
+	loadFunc := func(c *gin.Context) uint64 {
+		cost, _ := strconv.ParseUint(c.Query("cost"), 10, 64)
+		return cost
+	}
+
+	r.GET("/", ginLimiter.WithLoadFunc(loadFunc), func(c *gin.Context) {})
+
+	go func() {
+		err := r.Run(":9005")
+		if err != nil {
+			t.Error("error running the test http server", err.Error())
+		}
+	}()
+
+	waitForServer("127.0.0.1:9005")
+
+	// a single request costing the whole window budget is accepted...
+	resp, err := http.DefaultClient.Get("http://127.0.0.1:9005?cost=10")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// ...and exhausts it for a subsequent request, even a cheap one.
+	resp, err = http.DefaultClient.Get("http://127.0.0.1:9005?cost=1")
+	assert.NoError(t, err)
+	assert.Equal(t, 429, resp.StatusCode)
+}
+
+// TestRetryPolicy checks that a transient error from Limiter.Submit is
+// retried according to Config.RetryPolicy, and that the request ultimately
+// succeeds once the backend recovers.
+func TestRetryPolicy(t *testing.T) {
+	r := gin.Default()
+
+	limiter := &flakyLimiter{failures: 2}
+
+	ginLimiter := NewLimiterMiddleware(Config{
+		Limiter:          limiter,
+		DefaultRouteLoad: 1,
+		TenantKey:        "fixed",
+		RetryPolicy: RetryPolicy{
+			MaxRetries:      3,
+			InitialInterval: 5 * time.Millisecond,
+			MaxInterval:     20 * time.Millisecond,
+		},
+	})
+
+	r.GET("/", ginLimiter.Default(), func(c *gin.Context) {})
+
+	go func() {
+		err := r.Run(":9006")
+		if err != nil {
+			t.Error("error running the test http server", err.Error())
+		}
+	}()
+
+	waitForServer("127.0.0.1:9006")
+
+	resp, err := http.DefaultClient.Get("http://127.0.0.1:9006")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, 3, limiter.calls)
+}
+
+// TestTenantKeysComposite checks that Config.TenantKeys enforces every
+// bucket in one middleware pass, and that a rejection from any bucket
+// rejects the request and identifies the offending bucket via
+// MultiSubmitResult.RejectedName, even though other buckets still had budget.
+func TestTenantKeysComposite(t *testing.T) {
+	r := gin.Default()
+
+	globalLimiter, _ := goll.New(&goll.Config{
+		MaxLoad:    1,
+		WindowSize: 3 * time.Second,
+	})
+	perIPLimiter, _ := goll.New(&goll.Config{
+		MaxLoad:    100,
+		WindowSize: 3 * time.Second,
+	})
+
+	var rejectedName string
+
+	ginLimiter := NewLimiterMiddleware(Config{
+		DefaultRouteLoad: 1,
+		TenantKeys: []TenantKeySpec{
+			{
+				Name:    "global",
+				KeyFunc: func(c *gin.Context) (string, error) { return "global", nil },
+				Limiter: globalLimiter,
+			},
+			{
+				Name:    "perip",
+				KeyFunc: func(c *gin.Context) (string, error) { return c.ClientIP(), nil },
+				Limiter: perIPLimiter,
+			},
+		},
+		MultiAbortHandler: func(c *gin.Context, result MultiSubmitResult) {
+			rejectedName = result.RejectedName
+			c.AbortWithStatus(429)
+		},
+	})
+
+	r.GET("/", ginLimiter.Default(), func(c *gin.Context) {})
+
+	go func() {
+		err := r.Run(":9007")
+		if err != nil {
+			t.Error("error running the test http server", err.Error())
+		}
+	}()
+
+	waitForServer("127.0.0.1:9007")
+
+	// the first request uses up the tight global budget, well within the
+	// much looser per-IP budget.
+	resp, err := http.DefaultClient.Get("http://127.0.0.1:9007")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// the second request is still within its per-IP budget, but rejected by
+	// the exhausted global bucket.
+	resp, err = http.DefaultClient.Get("http://127.0.0.1:9007")
+	assert.NoError(t, err)
+	assert.Equal(t, 429, resp.StatusCode)
+	assert.Equal(t, "global", rejectedName)
+}
+
 func TestGinWithLoadLimiter(t *testing.T) {
 	r := gin.Default()
 
@@ -73,7 +492,7 @@ func TestGinWithLoadLimiter(t *testing.T) {
 		}
 	}()
 
-	runtime.Gosched()
+	waitForServer("127.0.0.1:9000")
 
 	// let's run a series of requests and check that
 	// the limiter breaks and restores in the expected way.